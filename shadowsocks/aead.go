@@ -0,0 +1,232 @@
+package shadowsocks
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// AEAD分片帧格式（替代OTA）：
+//
+//	[encrypted length(2 bytes) + length tag] [encrypted payload(<=0x3FFF bytes) + payload tag]
+//
+// 握手阶段不再像流式加密那样发送IV，而是发送一段与密钥等长的随机salt，
+// 双方各自用HKDF-SHA1(masterKey, salt, "ss-subkey")派生出本连接的子密钥。
+const (
+	aeadTagSize      = 16
+	aeadMaxChunkSize = 0x3FFF
+	aeadNonceSize    = 12
+	aeadSubkeyInfo   = "ss-subkey"
+)
+
+var errAEADMethodNotSupported = errors.New("shadowsocks: unsupported aead method")
+var errAEADChunkTooLarge = errors.New("shadowsocks: aead chunk length exceeds 0x3FFF")
+
+// aeadCipherInfo描述一种AEAD加密方式：密钥长度（也是握手salt的长度）和
+// 根据子密钥构造cipher.AEAD的方法。
+type aeadCipherInfo struct {
+	keySize int
+	newAEAD func(key []byte) (cipher.AEAD, error)
+}
+
+var aeadCipherMethod = map[string]*aeadCipherInfo{
+	"chacha20-ietf-poly1305": {chacha20poly1305.KeySize, chacha20poly1305.New},
+	"aes-256-gcm":            {32, newAESGCM},
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewAEADCipher返回一个使用method（chacha20-ietf-poly1305 / aes-256-gcm）
+// 派生主密钥的*Cipher，并把method对应的aeadCipherInfo记在Cipher.aeadInfo上。
+// NewConn/handshakeWithRawAddr都是从Cipher.aeadInfo（而不是另外传一个参数）
+// 判断该不该走AEAD分片帧格式，这样DialWithRawAddr/Dial/Dialer.DialContext
+// 这些已有的连接入口不用改调用方式，只要传入一个由NewAEADCipher构造的
+// Cipher就能自动握手成AEAD连接。真正的每连接子密钥和AEAD实例仍在Conn第一
+// 次读/写时才建立，参见aeadHandshakeEncrypt/Decrypt。
+func NewAEADCipher(method, password string) (*Cipher, error) {
+	info, ok := aeadCipherMethod[method]
+	if !ok {
+		return nil, errAEADMethodNotSupported
+	}
+	return &Cipher{key: aeadKDF(password, info.keySize), aeadInfo: info}, nil
+}
+
+// aeadKDF是shadowsocks一直使用的口令派生算法，等价于OpenSSL的
+// EVP_BytesToKey：反复对 前一轮输出+password 做MD5，拼接直到凑够keyLen字节。
+func aeadKDF(password string, keyLen int) []byte {
+	var out, prev []byte
+	h := md5.New()
+	for len(out) < keyLen {
+		h.Reset()
+		h.Write(prev)
+		h.Write([]byte(password))
+		out = h.Sum(out)
+		prev = out[len(out)-h.Size():]
+	}
+	return out[:keyLen]
+}
+
+// NewAEADConn用method/password包装一个net.Conn，得到的Conn在Read/Write时
+// 使用AEAD分片帧格式而不是流式加密+OTA，对调用者而言用法和NewConn产出的
+// Conn完全一样。用于服务端accept路径：这一端不需要发起rawaddr握手，第一次
+// Read会自动从对端读出salt并派生解密用的AEAD（参见aeadHandshakeDecrypt）。
+func NewAEADConn(c net.Conn, method, password string) (*Conn, error) {
+	ciph, err := NewAEADCipher(method, password)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(c, ciph), nil
+}
+
+func subkey(masterKey, salt []byte, size int) ([]byte, error) {
+	sk := make([]byte, size)
+	kdf := hkdf.New(sha1.New, masterKey, salt, []byte(aeadSubkeyInfo))
+	if _, err := io.ReadFull(kdf, sk); err != nil {
+		return nil, err
+	}
+	return sk, nil
+}
+
+func incNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
+
+// aeadHandshakeEncrypt在第一次Write时被调用：生成随机salt、派生子密钥、
+// 在明文连接上直接写出salt（相当于流式加密里的IV），并建立加密用的AEAD。
+func (c *Conn) aeadHandshakeEncrypt() error {
+	salt := make([]byte, c.aeadInfo.keySize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	sk, err := subkey(c.key, salt, c.aeadInfo.keySize)
+	if err != nil {
+		return err
+	}
+	aead, err := c.aeadInfo.newAEAD(sk)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Conn.Write(salt); err != nil {
+		return err
+	}
+	c.encAEAD = aead
+	c.encNonce = make([]byte, aeadNonceSize)
+	return nil
+}
+
+// aeadHandshakeDecrypt在第一次Read时被调用：读出对端发来的salt并派生出
+// 用于解密的AEAD。
+func (c *Conn) aeadHandshakeDecrypt() error {
+	salt := make([]byte, c.aeadInfo.keySize)
+	if _, err := io.ReadFull(c.Conn, salt); err != nil {
+		return err
+	}
+	sk, err := subkey(c.key, salt, c.aeadInfo.keySize)
+	if err != nil {
+		return err
+	}
+	aead, err := c.aeadInfo.newAEAD(sk)
+	if err != nil {
+		return err
+	}
+	c.decAEAD = aead
+	c.decNonce = make([]byte, aeadNonceSize)
+	return nil
+}
+
+// aeadWrite把b切成不超过aeadMaxChunkSize的分片，逐片加密后写到底层连接。
+func (c *Conn) aeadWrite(b []byte) (n int, err error) {
+	if c.encAEAD == nil {
+		if err = c.aeadHandshakeEncrypt(); err != nil {
+			return 0, err
+		}
+	}
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > aeadMaxChunkSize {
+			chunk = chunk[:aeadMaxChunkSize]
+		}
+
+		lenBuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(lenBuf, uint16(len(chunk)))
+		sealedLen := c.encAEAD.Seal(nil, c.encNonce, lenBuf, nil)
+		incNonce(c.encNonce)
+
+		sealedPayload := c.encAEAD.Seal(nil, c.encNonce, chunk, nil)
+		incNonce(c.encNonce)
+
+		if _, err = c.Conn.Write(append(sealedLen, sealedPayload...)); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// aeadRead解密一个或多个分片，跨多次Read调用缓存尚未被消费完的明文，
+// 因为调用者的b可能比解密出来的一整个分片还小。
+func (c *Conn) aeadRead(b []byte) (n int, err error) {
+	if len(c.aeadLeftover) > 0 {
+		n = copy(b, c.aeadLeftover)
+		c.aeadLeftover = c.aeadLeftover[n:]
+		return n, nil
+	}
+
+	if c.decAEAD == nil {
+		if err = c.aeadHandshakeDecrypt(); err != nil {
+			return 0, err
+		}
+	}
+
+	sealedLen := make([]byte, 2+aeadTagSize)
+	if _, err = io.ReadFull(c.Conn, sealedLen); err != nil {
+		return 0, err
+	}
+	lenBuf, err := c.decAEAD.Open(nil, c.decNonce, sealedLen, nil)
+	if err != nil {
+		return 0, err
+	}
+	incNonce(c.decNonce)
+
+	payloadLen := int(binary.BigEndian.Uint16(lenBuf))
+	if payloadLen > aeadMaxChunkSize {
+		return 0, errAEADChunkTooLarge
+	}
+
+	sealedPayload := make([]byte, payloadLen+aeadTagSize)
+	if _, err = io.ReadFull(c.Conn, sealedPayload); err != nil {
+		return 0, err
+	}
+	plain, err := c.decAEAD.Open(nil, c.decNonce, sealedPayload, nil)
+	if err != nil {
+		return 0, err
+	}
+	incNonce(c.decNonce)
+
+	n = copy(b, plain)
+	if n < len(plain) {
+		c.aeadLeftover = plain[n:]
+	}
+	return n, nil
+}
@@ -0,0 +1,61 @@
+package shadowsocks
+
+import "sync"
+
+// BufferPool是缓存池的抽象，Conn/PipeThenClose等需要临时缓冲区的地方都
+// 通过它申请/归还内存，使用者可以用SetBufferPool换成自己的实现（比如接
+// 自己的内存池做统一监控）。
+type BufferPool interface {
+	Get(size int) []byte
+	Put(buf []byte)
+}
+
+// bufferPoolTiers是默认缓存池的档位，Get时选用能放下size的最小档位，
+// 放不下64KB的请求则不进池子，直接分配、用完即丢给GC。这比原来固定大小
+// 的leakyBuf更适合吞吐量高、请求大小参差不齐的代理流量。
+var bufferPoolTiers = []int{2 * 1024, 8 * 1024, 32 * 1024, 64 * 1024}
+
+// defaultBufferPool是包内默认使用的缓存池，可以用SetBufferPool替换。
+var defaultBufferPool BufferPool = newTieredBufferPool(bufferPoolTiers)
+
+// SetBufferPool替换包内默认使用的缓存池。
+func SetBufferPool(p BufferPool) {
+	defaultBufferPool = p
+}
+
+type tieredBufferPool struct {
+	tiers []int
+	pools []sync.Pool
+}
+
+func newTieredBufferPool(tiers []int) *tieredBufferPool {
+	p := &tieredBufferPool{tiers: tiers, pools: make([]sync.Pool, len(tiers))}
+	for i := range tiers {
+		size := tiers[i]
+		p.pools[i].New = func() interface{} {
+			return make([]byte, size)
+		}
+	}
+	return p
+}
+
+func (p *tieredBufferPool) Get(size int) []byte {
+	for i, tier := range p.tiers {
+		if size <= tier {
+			buf := p.pools[i].Get().([]byte)
+			return buf[:size]
+		}
+	}
+	return make([]byte, size)
+}
+
+func (p *tieredBufferPool) Put(buf []byte) {
+	c := cap(buf)
+	for i, tier := range p.tiers {
+		if c == tier {
+			p.pools[i].Put(buf[:tier])
+			return
+		}
+	}
+	// 不是从某个档位的池子里拿出来的（比如请求超过了最大档位），直接丢弃。
+}
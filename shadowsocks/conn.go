@@ -1,11 +1,14 @@
 package shadowsocks
 
 import (
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
+	"sync"
 )
 
 const (
@@ -16,22 +19,40 @@ const (
 type Conn struct {
 	net.Conn
 	*Cipher
-	readBuf  []byte
-	writeBuf []byte
-	chunkId  uint32
+	chunkId uint32
+
+	// 以下字段仅在Cipher选用AEAD方式（chacha20-ietf-poly1305/aes-256-gcm）
+	// 时使用，握手、分片加解密都在aead.go里实现，不再经过initEncrypt/
+	// initDecrypt/encrypt/decrypt这套流式加密的路径。
+	aeadInfo     *aeadCipherInfo
+	encAEAD      cipher.AEAD
+	decAEAD      cipher.AEAD
+	encNonce     []byte
+	decNonce     []byte
+	aeadLeftover []byte
+
+	// watchDone非nil时，表示Dialer.DialContext给这个Conn绑定了一个
+	// context，Close负责停掉watchContext里那个监视它的goroutine。
+	// closeWatchOnce保证这个关闭动作只做一次，避免并发Close把同一个
+	// channel关两次而panic。
+	watchDone      chan struct{}
+	closeWatchOnce sync.Once
 }
 
 func NewConn(c net.Conn, cipher *Cipher) *Conn { //分配一个未初始化的SS连接
 	return &Conn{
-		Conn:     c,
-		Cipher:   cipher,
-		readBuf:  leakyBuf.Get(), //漏桶缓存，避免频繁的申请释放内存
-		writeBuf: leakyBuf.Get()} //从桶里面拿一块缓存
+		Conn:   c,
+		Cipher: cipher,
+		// cipher.aeadInfo非nil时说明cipher是NewAEADCipher构造出来的，这个
+		// Conn的Read/Write要走AEAD分片帧格式而不是流式加密+OTA。
+		aeadInfo: cipher.aeadInfo,
+	}
 }
 
 func (c *Conn) Close() error {
-	leakyBuf.Put(c.readBuf) //把缓存空间还给桶里
-	leakyBuf.Put(c.writeBuf)
+	if c.watchDone != nil {
+		c.closeWatchOnce.Do(func() { close(c.watchDone) })
+	}
 	return c.Conn.Close()
 }
 
@@ -65,12 +86,30 @@ func RawAddr(addr string) (buf []byte, err error) { //从Sock5的Req里面解析
 // This is intended for use by users implementing a local socks proxy.
 // rawaddr shoud contain part of the data in socks request, starting from the
 // ATYP field. (Refer to rfc1928 for more information.)
+//
+// DialWithRawAddr是零值Dialer.DialContextWithRawAddr（用context.Background()）
+// 的一层薄封装，和dialer.go里其他拨号入口共用同一套dialNetwork逻辑，
+// 不再自己直接调net.Dial。
 func DialWithRawAddr(rawaddr []byte, server string, cipher *Cipher) (c *Conn, err error) { //与远端SS-server服务器握手并返回连接
-	conn, err := net.Dial("tcp", server)
-	if err != nil {
+	return (&Dialer{}).DialContextWithRawAddr(context.Background(), rawaddr, server, cipher)
+}
+
+// handshakeWithRawAddr在一条已经建立好的net.Conn上完成SS的握手：cipher是
+// AEAD方式时走AEAD的分片帧格式，否则按需发送OTA的IV和认证信息，最后都是
+// 把rawaddr发出去。DialWithRawAddr在普通TCP连接上用它，DialTLS在TLS连接上
+// 用的也是同一套逻辑。
+func handshakeWithRawAddr(conn net.Conn, rawaddr []byte, cipher *Cipher) (c *Conn, err error) {
+	c = NewConn(conn, cipher)
+	if c.aeadInfo != nil {
+		// AEAD方式没有单独的握手步骤：salt生成、子密钥派生都在c.Write第一次
+		// 被调用时由aeadHandshakeEncrypt完成，rawaddr本身作为第一个分片
+		// 经c.Write（而不是下面流式加密专用的c.write）发出即可。
+		if _, err = c.Write(rawaddr); err != nil {
+			c.Close()
+			return nil, err
+		}
 		return
 	}
-	c = NewConn(conn, cipher)
 	if cipher.ota {
 		if c.enc == nil {
 			if _, err = c.initEncrypt(); err != nil {
@@ -90,12 +129,11 @@ func DialWithRawAddr(rawaddr []byte, server string, cipher *Cipher) (c *Conn, er
 }
 
 // addr should be in the form of host:port
+//
+// Dial是零值Dialer.DialContext（用context.Background()）的一层薄封装，见
+// Dialer的文档。
 func Dial(addr, server string, cipher *Cipher) (c *Conn, err error) { //封装ss连接，实现conn接口
-	ra, err := RawAddr(addr)
-	if err != nil {
-		return
-	}
-	return DialWithRawAddr(ra, server, cipher)
+	return (&Dialer{}).DialContext(context.Background(), addr, server, cipher)
 }
 
 func (c *Conn) GetIv() (iv []byte) {
@@ -121,6 +159,9 @@ func (c *Conn) GetAndIncrChunkId() (chunkId uint32) {
 }
 
 func (c *Conn) Read(b []byte) (n int, err error) { //实现IO接口的读，解密SS连接的流量
+	if c.aeadInfo != nil {
+		return c.aeadRead(b)
+	}
 	if c.dec == nil { //若解密表未初始化，则说明该读操作处于握手阶段，包前应该携带iv信息，读取并初始化解密表
 		/*
 			+-------+----------+
@@ -147,21 +188,19 @@ func (c *Conn) Read(b []byte) (n int, err error) { //实现IO接口的读，解
 		}
 	}
 
-	cipherData := c.readBuf //从桶中获取一个缓存
-	if len(b) > len(cipherData) {
-		cipherData = make([]byte, len(b)) //缓存大小不足，只能放弃使用漏桶缓存，使用常规buff
-	} else {
-		cipherData = cipherData[:len(b)]
-	}
-
-	n, err = c.Conn.Read(cipherData) //读数据
+	// 流式加密的XOR可以原地进行，直接把调用者的b当成密文读缓冲区，解密后
+	// 写回原处，省掉旧实现里“先读到cipherData再拷到b”的那次拷贝。
+	n, err = c.Conn.Read(b)
 	if n > 0 {
-		c.decrypt(b[0:n], cipherData[0:n]) //解密后写入B以返回
+		c.decrypt(b[0:n], b[0:n])
 	}
 	return
 }
 
 func (c *Conn) Write(b []byte) (n int, err error) { //实现IO的写接口
+	if c.aeadInfo != nil { //AEAD方式自带每分片的认证，完全替代OTA
+		return c.aeadWrite(b)
+	}
 	if c.ota { //自增包ID，用以一次验证，防止重放攻击
 		chunkId := c.GetAndIncrChunkId()
 		b = otaReqChunkAuth(c.iv, chunkId, b)
@@ -179,13 +218,9 @@ func (c *Conn) write(b []byte) (n int, err error) {
 		}
 	}
 
-	cipherData := c.writeBuf
 	dataSize := len(b) + len(iv)
-	if dataSize > len(cipherData) {
-		cipherData = make([]byte, dataSize)
-	} else {
-		cipherData = cipherData[:dataSize]
-	}
+	cipherData := defaultBufferPool.Get(dataSize) //按大小从分级的sync.Pool里取缓存，而不是旧的定长漏桶
+	defer defaultBufferPool.Put(cipherData)
 
 	//若iv == nil，则说明该写操作已经进入pipi阶段，发包前不携带有iv信息。
 	if iv != nil {
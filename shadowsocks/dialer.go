@@ -0,0 +1,77 @@
+package shadowsocks
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Dialer持有一组拨号参数，字段上镜像net.Dialer，但DialContext返回的是已经
+// 完成SS握手的*Conn。ProxyDialer非nil时，底层TCP连接通过它建立而不是直接
+// net.Dial，这样可以把shadowsocks-go接在一条已有的代理链路（比如先跳一次
+// 上游SOCKS5/HTTP代理）后面，而不是只能当链路最外层的leaf client。
+type Dialer struct {
+	Timeout     time.Duration
+	LocalAddr   net.Addr
+	Control     func(network, address string, c syscall.RawConn) error
+	ProxyDialer proxy.ContextDialer
+}
+
+// DialContext按addr（host:port）拨号到server、完成SS握手后返回*Conn；ctx
+// 被取消或超时时，正在阻塞的Read/Write会被打断并返回错误，参见
+// Conn.watchContext。
+func (d *Dialer) DialContext(ctx context.Context, addr, server string, cipher *Cipher) (*Conn, error) {
+	rawaddr, err := RawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialContextWithRawAddr(ctx, rawaddr, server, cipher)
+}
+
+// DialContextWithRawAddr和DialContext做的事情一样，只是直接接收已经编码好
+// 的rawaddr，供已经从SOCKS5请求里拿到原始地址字段的调用方（比如
+// socks.go的handleConnect，它需要保留客户端送来的ATYP，不能先转成
+// host:port字符串再用RawAddr重新编码一遍）使用。DialWithRawAddr/Dial也是
+// 靠它实现的，这样两条入口共用同一套dialNetwork/watchContext逻辑。
+func (d *Dialer) DialContextWithRawAddr(ctx context.Context, rawaddr []byte, server string, cipher *Cipher) (*Conn, error) {
+	conn, err := d.dialNetwork(ctx, "tcp", server)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := handshakeWithRawAddr(conn, rawaddr, cipher)
+	if err != nil {
+		return nil, err
+	}
+	c.watchContext(ctx)
+	return c, nil
+}
+
+func (d *Dialer) dialNetwork(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.ProxyDialer != nil {
+		return d.ProxyDialer.DialContext(ctx, network, addr)
+	}
+	nd := &net.Dialer{Timeout: d.Timeout, LocalAddr: d.LocalAddr, Control: d.Control}
+	return nd.DialContext(ctx, network, addr)
+}
+
+// watchContext让ctx的取消/超时能打断Conn上正在阻塞的Read/Write：ctx结束时
+// 用SetDeadline强制底层socket立即返回，调用方下一次I/O会拿到对应的网络
+// 错误而不是永远卡住。Conn.Close会停掉这个watcher，避免goroutine泄漏。
+func (c *Conn) watchContext(ctx context.Context) {
+	if ctx == nil || ctx.Done() == nil {
+		return
+	}
+	done := make(chan struct{})
+	c.watchDone = done
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+}
@@ -14,11 +14,15 @@ func SetReadTimeout(c net.Conn) { //设置tcp连接超时时间
 	}
 }
 
+// pipeBufferSize是PipeThenClose/PipeThenCloseOta从缓存池里申请的缓冲区大小，
+// 对应bufferPoolTiers里承载大块代理流量的档位。
+const pipeBufferSize = 32 * 1024
+
 // PipeThenClose copies data from src to dst, closes dst when done.
 func PipeThenClose(src, dst net.Conn) { //未启用一次验证的时候的管道模型
 	defer dst.Close()
-	buf := leakyBuf.Get() //从桶里拿一个缓存
-	defer leakyBuf.Put(buf)
+	buf := defaultBufferPool.Get(pipeBufferSize) //从分级缓存池里拿一个缓存
+	defer defaultBufferPool.Put(buf)
 	for { //一个管道循环，不停的从src读取，写入dst。src未加密，加密过程在ss.Write的接口实现中完成，写到dst中的已经是加密信息，并完成了包格式的构建。
 		SetReadTimeout(src) //设置等待超时
 		n, err := src.Read(buf)
@@ -57,8 +61,8 @@ func PipeThenCloseOta(src *Conn, dst net.Conn) { //启用一次验证的管道
 		dst.Close()
 	}()
 	// sometimes it have to fill large block
-	buf := leakyBuf.Get()
-	defer leakyBuf.Put(buf)
+	buf := defaultBufferPool.Get(pipeBufferSize)
+	defer defaultBufferPool.Put(buf)
 	for i := 1; ; i += 1 {
 		SetReadTimeout(src)
 		if n, err := io.ReadFull(src, buf[:dataLenLen+hmacSha1Len]); err != nil {
@@ -0,0 +1,338 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// SOCKS5 协议相关常量，参见 RFC 1928。
+const (
+	socksVer5 = 0x05
+
+	socksCmdConnect      = 0x01
+	socksCmdBind         = 0x02
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksRepSucceeded        = 0x00
+	socksRepGeneralFailure   = 0x01
+	socksRepCmdNotSupported  = 0x07
+	socksRepAtypNotSupported = 0x08
+)
+
+// Socks5Listener 是运行在本机的SOCKS5前端，接受应用程序发来的SOCKS5请求，
+// 将CONNECT/UDP ASSOCIATE转换为SS协议请求后转发给远端的shadowsocks服务器，
+// 这样使用者无需自己实现SOCKS5解析即可把本库当作本地代理来使用。
+type Socks5Listener struct {
+	net.Listener
+	server string // 远端 shadowsocks 服务器地址
+	cipher *Cipher
+}
+
+// ListenSocks5 在addr上监听TCP连接并作为SOCKS5服务端，所有请求经cipher加密后
+// 转发到server。返回的Socks5Listener需要调用Serve才会真正开始处理连接。
+func ListenSocks5(addr, server string, cipher *Cipher) (*Socks5Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Socks5Listener{Listener: ln, server: server, cipher: cipher}, nil
+}
+
+// Serve 不断Accept新连接并分别处理，直到Listener被关闭为止。
+func (l *Socks5Listener) Serve() error {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := l.handleConn(conn); err != nil {
+				Debug.Println("socks5:", err)
+			}
+		}()
+	}
+}
+
+func (l *Socks5Listener) handleConn(conn net.Conn) error {
+	defer conn.Close()
+
+	if err := socks5Handshake(conn); err != nil {
+		return fmt.Errorf("shadowsocks: socks5 handshake error %v", err)
+	}
+	cmd, rawaddr, err := socks5ReadRequest(conn)
+	if err != nil {
+		socks5Reply(conn, socksRepGeneralFailure, nil)
+		return fmt.Errorf("shadowsocks: socks5 read request error %v", err)
+	}
+
+	switch cmd {
+	case socksCmdConnect:
+		return l.handleConnect(conn, rawaddr)
+	case socksCmdUDPAssociate:
+		return l.handleUDPAssociate(conn, rawaddr)
+	default:
+		socks5Reply(conn, socksRepCmdNotSupported, nil)
+		return fmt.Errorf("shadowsocks: unsupported socks5 command %#x", cmd)
+	}
+}
+
+// socks5Handshake 完成SOCKS5方法协商阶段，目前只支持NO AUTHENTICATION REQUIRED。
+func socks5Handshake(conn net.Conn) error {
+	buf := make([]byte, 258)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socksVer5 {
+		return fmt.Errorf("unsupported socks version %#x", buf[0])
+	}
+	nMethods := int(buf[1])
+	if _, err := io.ReadFull(conn, buf[:nMethods]); err != nil {
+		return err
+	}
+	// 只接受NO AUTHENTICATION REQUIRED(0x00)，其余一律拒绝。
+	for _, m := range buf[:nMethods] {
+		if m == 0x00 {
+			_, err := conn.Write([]byte{socksVer5, 0x00})
+			return err
+		}
+	}
+	conn.Write([]byte{socksVer5, 0xFF})
+	return fmt.Errorf("no acceptable socks5 auth method")
+}
+
+// socks5ReadRequest 读取SOCKS5请求并将其地址部分转换为SS协议的rawaddr格式，
+// 即[ATYP][Destination Address][Destination Port]，与RawAddr产出的格式一致，
+// 但这里直接按照客户端送来的ATYP（IPv4/域名/IPv6）编码，而不是像RawAddr那样
+// 总是把地址当成域名处理。
+func socks5ReadRequest(conn net.Conn) (cmd byte, rawaddr []byte, err error) {
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return
+	}
+	if buf[0] != socksVer5 {
+		err = fmt.Errorf("unsupported socks version %#x", buf[0])
+		return
+	}
+	cmd = buf[1]
+	atyp := buf[3]
+
+	var addrBody []byte
+	switch atyp {
+	case socksAtypIPv4:
+		addrBody = make([]byte, net.IPv4len)
+		if _, err = io.ReadFull(conn, addrBody); err != nil {
+			return
+		}
+	case socksAtypIPv6:
+		addrBody = make([]byte, net.IPv6len)
+		if _, err = io.ReadFull(conn, addrBody); err != nil {
+			return
+		}
+	case socksAtypDomain:
+		lenBuf := make([]byte, 1)
+		if _, err = io.ReadFull(conn, lenBuf); err != nil {
+			return
+		}
+		addrBody = make([]byte, 1+int(lenBuf[0])) // 保留长度字节，方便与rawaddr的布局一致
+		addrBody[0] = lenBuf[0]
+		if _, err = io.ReadFull(conn, addrBody[1:]); err != nil {
+			return
+		}
+	default:
+		err = fmt.Errorf("unsupported atyp %#x", atyp)
+		return
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, portBuf); err != nil {
+		return
+	}
+
+	rawaddr = make([]byte, 1+len(addrBody)+2)
+	rawaddr[0] = atyp
+	copy(rawaddr[1:], addrBody)
+	copy(rawaddr[1+len(addrBody):], portBuf)
+	return
+}
+
+// socks5Reply 向客户端回复SOCKS5应答，bindAddr为nil时回复0.0.0.0:0。
+func socks5Reply(conn net.Conn, rep byte, bindAddr *net.UDPAddr) error {
+	reply := []byte{socksVer5, rep, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+	if bindAddr != nil {
+		if ip4 := bindAddr.IP.To4(); ip4 != nil {
+			copy(reply[4:8], ip4)
+		}
+		binary.BigEndian.PutUint16(reply[8:10], uint16(bindAddr.Port))
+	}
+	_, err := conn.Write(reply)
+	return err
+}
+
+// handleConnect 处理CONNECT请求：与SS服务器完成握手后，在两条连接之间建立
+// 双向管道，复用库里已有的PipeThenClose/PipeThenCloseOta。
+func (l *Socks5Listener) handleConnect(conn net.Conn, rawaddr []byte) error {
+	remote, err := DialWithRawAddr(rawaddr, l.server, l.cipher)
+	if err != nil {
+		socks5Reply(conn, socksRepGeneralFailure, nil)
+		return fmt.Errorf("shadowsocks: connect to server error %v", err)
+	}
+	defer remote.Close()
+
+	if err := socks5Reply(conn, socksRepSucceeded, nil); err != nil {
+		return err
+	}
+
+	// 本地->远端方向不需要PipeThenCloseOta：OTA的分片认证信息由remote.Write
+	// 内部（Conn.Write里的otaReqChunkAuth）自动附加，PipeThenClose按普通
+	// net.Conn搬运数据即可。PipeThenCloseOta只用于读取、校验来自SS一侧、
+	// 已经带着OTA认证信息的数据，也就是下面远端->本地的方向。
+	go PipeThenClose(conn, remote)
+	if remote.IsOta() {
+		PipeThenCloseOta(remote, conn)
+	} else {
+		PipeThenClose(remote, conn)
+	}
+	return nil
+}
+
+// handleUDPAssociate 处理UDP ASSOCIATE请求。本地应用发来的数据报剥去SOCKS5
+// UDP头后转成PacketConn.WriteTo所需的(payload, dstAddr)，经由DialUDP建立的
+// 到SS服务器的PacketConn加密转发；服务器的响应解密后，用PacketConn.DstAddr()
+// 取回原始目的地址，重新套上SOCKS5 UDP头后送回本地应用。关联随控制用的TCP
+// 连接一起结束。
+func (l *Socks5Listener) handleUDPAssociate(conn net.Conn, _ []byte) error {
+	appConn, err := net.ListenPacket("udp", "")
+	if err != nil {
+		socks5Reply(conn, socksRepGeneralFailure, nil)
+		return fmt.Errorf("shadowsocks: listen udp for associate error %v", err)
+	}
+	defer appConn.Close()
+
+	pc, err := DialUDP(l.server, l.cipher)
+	if err != nil {
+		socks5Reply(conn, socksRepGeneralFailure, nil)
+		return fmt.Errorf("shadowsocks: dial udp server error %v", err)
+	}
+	defer pc.Close()
+
+	if err := socks5Reply(conn, socksRepSucceeded, appConn.LocalAddr().(*net.UDPAddr)); err != nil {
+		return err
+	}
+
+	// appAddr被两个独立的goroutine并发读写（下面分别标注为"写入方"和
+	// "读取方"），必须靠appAddrMu保护，否则appAddr是net.Addr这种双字接口
+	// 值，读取方可能看到一个撕裂的、指向错误具体类型的值，进而在WriteTo
+	// 里panic或者发错地址。
+	var (
+		appAddrMu sync.Mutex
+		appAddr   net.Addr
+	)
+	errCh := make(chan error, 3)
+
+	go func() {
+		// 控制连接一旦关闭（或出现任何读取错误），说明客户端结束了这次UDP ASSOCIATE。
+		buf := make([]byte, 1)
+		conn.Read(buf)
+		errCh <- io.EOF
+	}()
+
+	// 本地应用 -> SS服务器
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, from, err := appConn.ReadFrom(buf)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			appAddrMu.Lock()
+			appAddr = from
+			appAddrMu.Unlock()
+			dstAddr, payload, err := parseSocksUDPDatagram(buf[:n])
+			if err != nil {
+				Debug.Println("socks5 udp datagram:", err)
+				continue
+			}
+			if _, err := pc.WriteTo(payload, dstAddr); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	// SS服务器 -> 本地应用
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				errCh <- err
+				return
+			}
+			appAddrMu.Lock()
+			dst := appAddr
+			appAddrMu.Unlock()
+			if dst == nil {
+				continue
+			}
+			reply := buildSocksUDPHeader(pc.DstAddr())
+			reply = append(reply, buf[:n]...)
+			if _, err := appConn.WriteTo(reply, dst); err != nil {
+				errCh <- err
+				return
+			}
+		}
+	}()
+
+	return <-errCh
+}
+
+// parseSocksUDPDatagram解析本地应用发来的SOCKS5 UDP数据报
+// ([RSV(2)][FRAG(1)][ATYP...ADDR...PORT][DATA])，返回目的地址和payload。
+func parseSocksUDPDatagram(buf []byte) (dstAddr net.Addr, payload []byte, err error) {
+	if len(buf) < 4 {
+		return nil, nil, fmt.Errorf("shadowsocks: socks5 udp datagram too short")
+	}
+	addrLen, err := rawAddrHeaderLen(buf[3:])
+	if err != nil {
+		return nil, nil, err
+	}
+	dstAddr, err = parseRawAddr(buf[3 : 3+addrLen])
+	if err != nil {
+		return nil, nil, err
+	}
+	return dstAddr, buf[3+addrLen:], nil
+}
+
+// buildSocksUDPHeader构造SOCKS5 UDP头([RSV(2)][FRAG(1)][ATYP][ADDR][PORT])，
+// 用于把服务器的响应重新包装成本地应用能识别的数据报。
+func buildSocksUDPHeader(addr net.Addr) []byte {
+	host, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return []byte{0, 0, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	var header []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			header = append([]byte{0, 0, 0, socksAtypIPv4}, ip4...)
+		} else {
+			header = append([]byte{0, 0, 0, socksAtypIPv6}, ip.To16()...)
+		}
+	} else {
+		header = append([]byte{0, 0, 0, socksAtypDomain, byte(len(host))}, []byte(host)...)
+	}
+
+	portBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBuf, uint16(port))
+	return append(header, portBuf...)
+}
@@ -0,0 +1,36 @@
+package shadowsocks
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestParseSocksUDPDatagramRoundTrip(t *testing.T) {
+	header := []byte{0x00, 0x00, 0x00, socksAtypIPv4, 127, 0, 0, 1, 0x1F, 0x90} // 127.0.0.1:8080
+	payload := []byte("hello")
+	datagram := append(append([]byte{}, header...), payload...)
+
+	dstAddr, gotPayload, err := parseSocksUDPDatagram(datagram)
+	if err != nil {
+		t.Fatalf("parseSocksUDPDatagram: %v", err)
+	}
+	if !bytes.Equal(gotPayload, payload) {
+		t.Fatalf("payload = %q, want %q", gotPayload, payload)
+	}
+	udpAddr, ok := dstAddr.(*net.UDPAddr)
+	if !ok || udpAddr.Port != 8080 || !udpAddr.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("dstAddr = %#v, want 127.0.0.1:8080", dstAddr)
+	}
+
+	rebuilt := buildSocksUDPHeader(udpAddr)
+	if !bytes.Equal(rebuilt, header) {
+		t.Fatalf("buildSocksUDPHeader = %x, want %x", rebuilt, header)
+	}
+}
+
+func TestParseSocksUDPDatagramTooShort(t *testing.T) {
+	if _, _, err := parseSocksUDPDatagram([]byte{0, 0}); err == nil {
+		t.Fatal("expected error for truncated datagram")
+	}
+}
@@ -0,0 +1,125 @@
+package shadowsocks
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// alpnProtocol是在TLS握手里用来声明“这其实是shadowsocks流量”的ALPN协议
+// 名，客户端和服务端都通过tls.Config.NextProtos声明它；协商不到这个协议
+// 的连接一律交给普通的HTTP兜底handler处理。
+const alpnProtocol = "ss/1"
+
+// TLSListener把shadowsocks服务端包装在一个看起来和真实HTTPS网站没有区别
+// 的TLS监听端口后面：证书由autocert.Manager按需向Let's Encrypt申请并在
+// cacheDir里缓存、续期，这样主动探测这个端口的DPI设备看到的只是一次正常
+// 的TLS握手。
+type TLSListener struct {
+	net.Listener
+	cipher *Cipher
+}
+
+// ListenTLS在addr上监听，domain必须能解析到本机并通过TLS-ALPN-01验证（这里
+// 没有挂autocert的HTTPHandler，所以不走HTTP-01），email用于Let's Encrypt账号注册（可以留空），cacheDir保存申请到的
+// 证书以便进程重启后复用，不用每次都重新申请。
+func ListenTLS(addr, domain, cacheDir, email string, cipher *Cipher) (*TLSListener, error) {
+	mgr := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domain),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	tlsConfig := mgr.TLSConfig()
+	tlsConfig.NextProtos = append(tlsConfig.NextProtos, alpnProtocol)
+
+	ln, err := tls.Listen("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return &TLSListener{Listener: ln, cipher: cipher}, nil
+}
+
+// Serve接受TLS连接：ALPN协商到alpnProtocol的交给handleConn当作普通的
+// shadowsocks Conn处理；其余一律转发给fallback（留空则回404），这样这个
+// 端口在外人看来就是个普普通通、什么都没有的网站。
+func (l *TLSListener) Serve(handleConn func(*Conn), fallback http.Handler) error {
+	if fallback == nil {
+		fallback = http.NotFoundHandler()
+	}
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return err
+		}
+		tlsConn, ok := conn.(*tls.Conn)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		go func() {
+			if err := tlsConn.Handshake(); err != nil {
+				Debug.Println("tls handshake:", err)
+				tlsConn.Close()
+				return
+			}
+			if tlsConn.ConnectionState().NegotiatedProtocol == alpnProtocol {
+				handleConn(NewConn(tlsConn, l.cipher))
+				return
+			}
+			http.Serve(newSingleConnListener(tlsConn), fallback)
+		}()
+	}
+}
+
+// singleConnListener让http.Serve在一条已经握手完成的连接上跑一次，配合
+// 上面的HTTP兜底分支使用。
+type singleConnListener struct {
+	conn net.Conn
+	done bool
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	return &singleConnListener{conn: conn}
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if l.done {
+		return nil, io.EOF
+	}
+	l.done = true
+	return l.conn, nil
+}
+
+// http.Server.Serve在Serve返回前会defer调用这个Close，必须真正关掉l.conn，
+// 否则每一条没有协商到ss/1、被丢给HTTP兜底处理的TLS连接（这个监听器存在
+// 的意义就是要暴露在公网上接住这类流量）在http.Serve返回后都会连接泄漏，
+// fd迟早耗尽。
+func (l *singleConnListener) Close() error   { return l.conn.Close() }
+func (l *singleConnListener) Addr() net.Addr { return l.conn.LocalAddr() }
+
+// DialTLS通过TLS连接到server，SNI使用sni（通常与服务端ListenTLS的domain
+// 一致），握手并通过ALPN声明自己是shadowsocks流量后，在其上完成常规的SS
+// 握手。返回的Conn和Dial()产出的用法完全一样，PipeThenClose等上层代码都
+// 不需要改动。
+func DialTLS(addr, server, sni string, cipher *Cipher) (c *Conn, err error) {
+	rawaddr, err := RawAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	tcpConn, err := net.Dial("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(tcpConn, &tls.Config{ServerName: sni, NextProtos: []string{alpnProtocol}})
+	if err = tlsConn.Handshake(); err != nil {
+		tcpConn.Close()
+		return nil, err
+	}
+
+	return handshakeWithRawAddr(tlsConn, rawaddr, cipher)
+}
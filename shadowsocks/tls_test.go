@@ -0,0 +1,36 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+)
+
+// trackedConn只用来记录Close是否被调用过，验证singleConnListener.Close
+// 会把这个动作转发给它包装的net.Conn。
+type trackedConn struct {
+	net.Conn
+	closed bool
+}
+
+func (c *trackedConn) Close() error {
+	c.closed = true
+	return c.Conn.Close()
+}
+
+func TestSingleConnListenerCloseClosesConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	tracked := &trackedConn{Conn: server}
+	l := newSingleConnListener(tracked)
+
+	if _, err := l.Accept(); err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if !tracked.closed {
+		t.Fatal("singleConnListener.Close did not close the wrapped conn")
+	}
+}
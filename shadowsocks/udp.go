@@ -0,0 +1,318 @@
+package shadowsocks
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PacketConn包装一个net.PacketConn和一个*Cipher，按shadowsocks的UDP包格式
+// [IV][encrypted(ATYP+DstAddr+DstPort+Payload)]收发数据报，用法上和普通的
+// net.PacketConn一致，但WriteTo/ReadFrom多做了一层加解密和地址头的编解码。
+//
+// 通过DialUDP得到的PacketConn固定与一个SS服务器通信：WriteTo的addr参数是
+// 希望经由该服务器访问的最终目的地址，会被编码进包头，实际UDP报文始终物理
+// 发往服务器；ReadFrom返回的addr是数据报的物理来源（即服务器地址），解码
+// 出来的原始目的地址可以用DstAddr()取得，配合SOCKS5 UDP ASSOCIATE把响应
+// 送回本地应用时会用到。
+//
+// 通过ListenPacket得到的PacketConn没有固定对端，多用在shadowsocks服务端，
+// 配合PipeUDP在多个客户端之间转发。
+type PacketConn struct {
+	net.PacketConn
+	*Cipher
+
+	dialedAddr  net.Addr // 非nil时表示由DialUDP创建，所有包物理发往这个地址
+	lastDstAddr net.Addr // 上一次ReadFrom解码出的目的地址
+}
+
+// NewPacketConn用cipher包装一个已经建立好的net.PacketConn。
+func NewPacketConn(c net.PacketConn, cipher *Cipher) *PacketConn {
+	return &PacketConn{PacketConn: c, Cipher: cipher}
+}
+
+// ListenPacket在addr上监听UDP，返回的PacketConn没有固定对端，可以和任意
+// 多个shadowsocks对端收发加密数据报。
+func ListenPacket(addr string, cipher *Cipher) (*PacketConn, error) {
+	c, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewPacketConn(c, cipher), nil
+}
+
+// DialUDP创建一个固定和server通信的PacketConn，是Dial()的UDP版本。
+func DialUDP(server string, cipher *Cipher) (*PacketConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", server)
+	if err != nil {
+		return nil, err
+	}
+	c, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return &PacketConn{PacketConn: c, Cipher: cipher, dialedAddr: raddr}, nil
+}
+
+// WriteTo把addr编码进shadowsocks的地址头、加密后发送。若该PacketConn是
+// DialUDP创建的，则报文物理发往拨号时指定的服务器，addr只用于编码地址头；
+// 否则（即ListenPacket创建的）报文物理发往addr本身。
+func (c *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	rawaddr, err := RawAddr(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	packet, err := encryptUDPPacket(c.Cipher, append(rawaddr, b...))
+	if err != nil {
+		return 0, err
+	}
+	physical := addr
+	if c.dialedAddr != nil {
+		physical = c.dialedAddr
+	}
+	return c.PacketConn.WriteTo(packet, physical)
+}
+
+// ReadFrom解密收到的数据报，返回其物理来源地址；解码出的原始目的地址
+// 可通过随后调用DstAddr()取得。
+func (c *PacketConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	buf := make([]byte, 64*1024)
+	nRead, from, err := c.PacketConn.ReadFrom(buf)
+	if err != nil {
+		return 0, nil, err
+	}
+	rawaddr, payload, err := decryptUDPPacket(c.Cipher, buf[:nRead])
+	if err != nil {
+		return 0, nil, err
+	}
+	dstAddr, err := parseRawAddr(rawaddr)
+	if err != nil {
+		return 0, nil, err
+	}
+	c.lastDstAddr = dstAddr
+	n = copy(b, payload)
+	return n, from, nil
+}
+
+// DstAddr返回上一次ReadFrom解码出的原始目的地址。
+func (c *PacketConn) DstAddr() net.Addr {
+	return c.lastDstAddr
+}
+
+// PipeUDP用于shadowsocks服务端场景：clientPC是监听在SS协议端口、同时和
+// 多个客户端打交道的加密PacketConn。serverPC是调用方按自己需要绑定好的
+// 出口socket（比如通过net.ListenConfig.Control绑到特定网卡/网段地址），
+// PipeUDP并不直接复用serverPC本身收发数据——多个客户端仍需要各自独立的
+// NAT表项以免响应串到别的客户端——而是照着serverPC.LocalAddr()的IP，为每
+// 个客户端来源地址（5元组）在NAT表里分配一个绑在同一本地地址上的原始UDP
+// socket，然后双向转发；natTimeout内没有收到回包的NAT表项会被回收（客户端
+// 继续发出的流量不会延长这个时限）。效果上
+// 和PipeThenClose在一对TCP连接间转发数据是一致的。
+//
+// SS协议的加解密和NAT表路由是两件独立的事，后者被拆到udpNAT里：一是
+// PipeUDP本身已经够长，二是udpNAT.relay不牵扯*Cipher，可以在不搭建真实
+// shadowsocks加解密的情况下单独验证路由/绑定地址是否正确，参见udp_test.go。
+func PipeUDP(clientPC *PacketConn, serverPC net.PacketConn, natTimeout time.Duration) error {
+	nat := newUDPNAT(outboundLocalAddr(serverPC), natTimeout)
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, clientAddr, err := clientPC.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		rawaddr, payload, err := decryptUDPPacket(clientPC.Cipher, buf[:n])
+		if err != nil {
+			Debug.Println("pipeudp: decrypt:", err)
+			continue
+		}
+		dstAddr, err := parseRawAddr(rawaddr)
+		if err != nil {
+			Debug.Println("pipeudp: parse dst addr:", err)
+			continue
+		}
+
+		err = nat.relay(clientAddr, dstAddr, payload, func(clientAddr, from net.Addr, respPayload []byte) {
+			fromRawaddr, err := RawAddr(from.String())
+			if err != nil {
+				return
+			}
+			packet, err := encryptUDPPacket(clientPC.Cipher, append(fromRawaddr, respPayload...))
+			if err != nil {
+				return
+			}
+			clientPC.PacketConn.WriteTo(packet, clientAddr)
+		})
+		if err != nil {
+			Debug.Println("pipeudp: relay:", err)
+		}
+	}
+}
+
+// outboundLocalAddr从serverPC.LocalAddr()里取出IP和Zone，作为udpNAT给每个
+// 客户端分配的出口socket的绑定模板；serverPC为nil或者其LocalAddr不是
+// *net.UDPAddr时返回nil，等价于不限定本地地址（net.ListenUDP("udp", nil)）。
+func outboundLocalAddr(serverPC net.PacketConn) *net.UDPAddr {
+	if serverPC == nil {
+		return nil
+	}
+	udpAddr, ok := serverPC.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil
+	}
+	return &net.UDPAddr{IP: udpAddr.IP, Zone: udpAddr.Zone}
+}
+
+// udpNAT按客户端来源地址（5元组）维护一张NAT表，每个客户端各自独占一个
+// 绑在outLaddr上的原始UDP socket用来访问真实目的地，避免不同客户端的
+// 响应互相串号；natTimeout内没有收到回包的表项会被回收。
+type udpNAT struct {
+	mu         sync.Mutex
+	entries    map[string]*udpNATEntry
+	outLaddr   *net.UDPAddr
+	natTimeout time.Duration
+}
+
+type udpNATEntry struct {
+	raw        net.PacketConn
+	clientAddr net.Addr
+}
+
+func newUDPNAT(outLaddr *net.UDPAddr, natTimeout time.Duration) *udpNAT {
+	return &udpNAT{
+		entries:    make(map[string]*udpNATEntry),
+		outLaddr:   outLaddr,
+		natTimeout: natTimeout,
+	}
+}
+
+// relay把已解密的payload转发给dstAddr。clientAddr首次出现时会分配一个新
+// 的NAT表项，并起一个goroutine把该表项收到的回包经onReply(clientAddr,
+// from, payload)送回去；natTimeout内没有回包则回收该表项。
+func (nat *udpNAT) relay(clientAddr, dstAddr net.Addr, payload []byte, onReply func(clientAddr, from net.Addr, payload []byte)) error {
+	key := clientAddr.String()
+
+	nat.mu.Lock()
+	entry, ok := nat.entries[key]
+	nat.mu.Unlock()
+	if !ok {
+		raw, err := net.ListenUDP("udp", nat.outLaddr)
+		if err != nil {
+			return err
+		}
+		entry = &udpNATEntry{raw: raw, clientAddr: clientAddr}
+		nat.mu.Lock()
+		nat.entries[key] = entry
+		nat.mu.Unlock()
+
+		go func() {
+			defer func() {
+				raw.Close()
+				nat.mu.Lock()
+				delete(nat.entries, key)
+				nat.mu.Unlock()
+			}()
+			respBuf := make([]byte, 64*1024)
+			for {
+				raw.SetReadDeadline(time.Now().Add(nat.natTimeout))
+				n, from, err := raw.ReadFrom(respBuf)
+				if err != nil {
+					return
+				}
+				onReply(entry.clientAddr, from, respBuf[:n])
+			}
+		}()
+	}
+
+	_, err := entry.raw.WriteTo(payload, dstAddr)
+	return err
+}
+
+// encryptUDPPacket把一段明文的SS数据报([ATYP+ADDR+PORT][DATA])加密成
+// [IV][encrypted data]，每个数据报都使用独立的IV，与TCP流式加密不同。
+func encryptUDPPacket(cipher *Cipher, data []byte) ([]byte, error) {
+	c := cipher.Copy()
+	iv, err := c.initEncrypt()
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, len(iv)+len(data))
+	copy(packet, iv)
+	c.encrypt(packet[len(iv):], data)
+	return packet, nil
+}
+
+// decryptUDPPacket解密encryptUDPPacket产出的数据报，返回其中的rawaddr部分
+// （[ATYP+ADDR+PORT]）与payload部分。
+func decryptUDPPacket(cipher *Cipher, packet []byte) (rawaddr, payload []byte, err error) {
+	c := cipher.Copy()
+	ivLen := c.info.ivLen
+	if len(packet) < ivLen {
+		return nil, nil, fmt.Errorf("shadowsocks: udp packet too short")
+	}
+	if err = c.initDecrypt(packet[:ivLen]); err != nil {
+		return nil, nil, err
+	}
+	plain := make([]byte, len(packet)-ivLen)
+	c.decrypt(plain, packet[ivLen:])
+
+	if len(plain) < 1 {
+		return nil, nil, fmt.Errorf("shadowsocks: udp packet missing address header")
+	}
+	addrLen, err := rawAddrHeaderLen(plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	return plain[:addrLen], plain[addrLen:], nil
+}
+
+// rawAddrHeaderLen返回rawaddr格式([ATYP+ADDR+PORT])地址部分在buf开头的长度。
+func rawAddrHeaderLen(buf []byte) (int, error) {
+	if len(buf) < 1 {
+		return 0, fmt.Errorf("shadowsocks: address header too short")
+	}
+	switch buf[0] {
+	case socksAtypIPv4:
+		return 1 + net.IPv4len + 2, nil
+	case socksAtypIPv6:
+		return 1 + net.IPv6len + 2, nil
+	case socksAtypDomain:
+		if len(buf) < 2 {
+			return 0, fmt.Errorf("shadowsocks: truncated domain address header")
+		}
+		return 1 + 1 + int(buf[1]) + 2, nil
+	default:
+		return 0, fmt.Errorf("shadowsocks: unsupported atyp %#x in address header", buf[0])
+	}
+}
+
+// parseRawAddr把rawaddr格式([ATYP+ADDR+PORT])的地址头解析成net.Addr。
+func parseRawAddr(rawaddr []byte) (net.Addr, error) {
+	addrLen, err := rawAddrHeaderLen(rawaddr)
+	if err != nil {
+		return nil, err
+	}
+	if len(rawaddr) < addrLen {
+		return nil, fmt.Errorf("shadowsocks: truncated raw address")
+	}
+	switch rawaddr[0] {
+	case socksAtypIPv4:
+		ip := net.IP(rawaddr[1 : 1+net.IPv4len])
+		port := binary.BigEndian.Uint16(rawaddr[1+net.IPv4len : addrLen])
+		return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+	case socksAtypIPv6:
+		ip := net.IP(rawaddr[1 : 1+net.IPv6len])
+		port := binary.BigEndian.Uint16(rawaddr[1+net.IPv6len : addrLen])
+		return &net.UDPAddr{IP: ip, Port: int(port)}, nil
+	case socksAtypDomain:
+		hostLen := int(rawaddr[1])
+		host := string(rawaddr[2 : 2+hostLen])
+		port := binary.BigEndian.Uint16(rawaddr[2+hostLen : addrLen])
+		return net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	default:
+		return nil, fmt.Errorf("shadowsocks: unsupported atyp %#x", rawaddr[0])
+	}
+}
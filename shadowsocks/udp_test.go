@@ -0,0 +1,91 @@
+package shadowsocks
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestUDPNATRelayRoutesRepliesToOwningClient模拟两个"客户端"共用同一个
+// udpNAT，各自访问同一个"远端"echo服务器，验证回包只会送回发起请求的那
+// 个客户端，不会串到另一个客户端上。这部分逻辑不牵扯shadowsocks的
+// 加解密，PipeUDP只是在decrypt之后调用它。
+func TestUDPNATRelayRoutesRepliesToOwningClient(t *testing.T) {
+	echoConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP echo: %v", err)
+	}
+	defer echoConn.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echoConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echoConn.WriteTo(buf[:n], from)
+		}
+	}()
+	echoAddr := echoConn.LocalAddr()
+
+	nat := newUDPNAT(nil, time.Second)
+
+	type reply struct {
+		clientAddr net.Addr
+		payload    []byte
+	}
+	replies := make(chan reply, 2)
+	onReply := func(clientAddr, from net.Addr, payload []byte) {
+		got := make([]byte, len(payload))
+		copy(got, payload)
+		replies <- reply{clientAddr: clientAddr, payload: got}
+	}
+
+	clientA := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1111}
+	clientB := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2222}
+
+	if err := nat.relay(clientA, echoAddr, []byte("from-A"), onReply); err != nil {
+		t.Fatalf("relay A: %v", err)
+	}
+	if err := nat.relay(clientB, echoAddr, []byte("from-B"), onReply); err != nil {
+		t.Fatalf("relay B: %v", err)
+	}
+
+	seen := map[string]string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-replies:
+			seen[r.clientAddr.String()] = string(r.payload)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for replies")
+		}
+	}
+
+	if seen[clientA.String()] != "from-A" {
+		t.Fatalf("client A got %q, want %q", seen[clientA.String()], "from-A")
+	}
+	if seen[clientB.String()] != "from-B" {
+		t.Fatalf("client B got %q, want %q", seen[clientB.String()], "from-B")
+	}
+}
+
+// TestOutboundLocalAddrHonorsServerPC验证PipeUDP会把serverPC的本地IP当成
+// 出口socket的绑定模板。
+func TestOutboundLocalAddrHonorsServerPC(t *testing.T) {
+	serverPC, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("ListenUDP: %v", err)
+	}
+	defer serverPC.Close()
+
+	got := outboundLocalAddr(serverPC)
+	if got == nil || !got.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Fatalf("outboundLocalAddr = %#v, want IP 127.0.0.1", got)
+	}
+}
+
+func TestOutboundLocalAddrNilServerPC(t *testing.T) {
+	if got := outboundLocalAddr(nil); got != nil {
+		t.Fatalf("outboundLocalAddr(nil) = %#v, want nil", got)
+	}
+}